@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"os"
+
+	webpencoder "github.com/kolesa-team/go-webp/encoder"
+	"github.com/kolesa-team/go-webp/webp"
+	"github.com/nickalie/go-webpbin"
+)
+
+type encodeOptions struct {
+	quality  uint
+	lossless bool
+}
+
+// encoder converts a source image to a webp file. cwebpEncoder shells out to
+// the cwebp binary, reading the source path directly when img is nil and a
+// temporary PNG of img otherwise; nativeEncoder re-encodes an already-decoded
+// image in process.
+type encoder interface {
+	encode(srcPath string, img image.Image, outputFile string, opts encodeOptions) error
+}
+
+func newEncoder(name string) (encoder, error) {
+	switch name {
+	case "cwebp":
+		return cwebpEncoder{}, nil
+	case "native":
+		return nativeEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("unknown -encoder %q (want cwebp or native)", name)
+	}
+}
+
+// decodeImage opens and decodes path using the standard library's jpeg/png
+// codecs registered for side effects above.
+func decodeImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// cwebpEncoder is the original behaviour: shell out to the cwebp binary.
+type cwebpEncoder struct{}
+
+func (cwebpEncoder) encode(srcPath string, img image.Image, outputFile string, opts encodeOptions) error {
+	runner := webpbin.NewCWebP().Quality(opts.quality)
+
+	if img == nil {
+		return runner.InputFile(srcPath).OutputFile(outputFile).Run()
+	}
+
+	// a transform pipeline already decoded and mutated the image, so feed
+	// cwebp from a throwaway PNG instead of the untransformed source
+	tmp, err := writeTempPNG(img)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	return runner.InputFile(tmp).OutputFile(outputFile).Run()
+}
+
+func writeTempPNG(img image.Image) (string, error) {
+	f, err := os.CreateTemp("", "gowebp-*.png")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// nativeEncoder encodes in process with no external binary dependency.
+type nativeEncoder struct{}
+
+func (nativeEncoder) encode(_ string, img image.Image, outputFile string, opts encodeOptions) error {
+	if img == nil {
+		return fmt.Errorf("native encoder requires a decoded image")
+	}
+
+	var (
+		encOpts *webpencoder.Options
+		err     error
+	)
+	if opts.lossless {
+		encOpts, err = webpencoder.NewLosslessEncoderOptions(webpencoder.PresetDefault, 6)
+	} else {
+		encOpts, err = webpencoder.NewLossyEncoderOptions(webpencoder.PresetDefault, float32(opts.quality))
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return webp.Encode(f, img, encOpts)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	phuslog "github.com/phuslu/log"
+)
+
+// logger is the per-file message sink. job.execute never writes to stdout
+// directly so that -log-format and the progress bar can agree on how and
+// where a line lands.
+type logger interface {
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// newLogger builds the logger selected by -log-format, backed by a
+// phuslu/log.Logger and wired to write above bar so per-file lines never
+// corrupt an active progress bar.
+func newLogger(format string, bar *progressBar) (logger, error) {
+	w := barWriter{bar: bar}
+
+	switch format {
+	case "text":
+		return &phusluLogger{l: &phuslog.Logger{Writer: &phuslog.ConsoleWriter{Writer: w}}}, nil
+	case "json":
+		return &phusluLogger{l: &phuslog.Logger{Writer: phuslog.IOWriter{Writer: w}}}, nil
+	case "pretty":
+		return &phusluLogger{l: &phuslog.Logger{Writer: &phuslog.ConsoleWriter{Writer: w, ColorOutput: true}}}, nil
+	default:
+		return nil, fmt.Errorf("unknown -log-format %q (want text, json or pretty)", format)
+	}
+}
+
+// phusluLogger adapts a phuslu/log.Logger, which the fields above configure
+// for plain text, JSON or colourised console output, to the logger interface.
+type phusluLogger struct {
+	l *phuslog.Logger
+}
+
+func (l *phusluLogger) Infof(format string, args ...interface{}) {
+	l.l.Info().Msgf(format, args...)
+}
+
+func (l *phusluLogger) Warnf(format string, args ...interface{}) {
+	l.l.Warn().Msgf(format, args...)
+}
+
+func (l *phusluLogger) Errorf(format string, args ...interface{}) {
+	l.l.Error().Msgf(format, args...)
+}
+
+// barWriter adapts progressBar.writeAbove to an io.Writer so it can be
+// plugged in as a phuslu/log Writer's output. It trims the trailing newline
+// phuslu/log's writers already append, since writeAbove supplies its own.
+type barWriter struct {
+	bar *progressBar
+}
+
+func (w barWriter) Write(p []byte) (int, error) {
+	w.bar.writeAbove(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
@@ -2,24 +2,29 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/c2h5oh/datasize"
-	"github.com/nickalie/go-webpbin"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"image"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 )
 
 func printLogo() {
 	fmt.Print(`
-                                 _            
-                                | |           
-  ____    ___  __      __  ___  | |__    _ __  
+                                 _
+                                | |
+  ____    ___  __      __  ___  | |__    _ __
  / _  |  / _ \ \ \ /\ / / / _ \ | '_ \  | '_ \
 | (_| | | (_) | \ V  V / |  __/ | |_) | | |_) |
 \___, |  \___/   \_/\_/   \___| |_.__/  | .__/
@@ -40,12 +45,27 @@ var (
 	appendToName     string
 	inputMinFileSize string
 	minFileSize      datasize.ByteSize
+	inputMaxPending  string
+	maxPendingBytes  datasize.ByteSize
+	logFormat        string
+	showProgress     bool
+	appLogger        logger
+	bar              *progressBar
+	encoderName      string
+	lossless         bool
+	selectedEncoder  encoder
+	inputTransforms  string
+	transforms       []transform
+	inputManifest    string
+	activeManifest   *manifest
+	inputEmitPicture string
+	emitPictureMode  pictureMode
+	webRoot          string
+	pictureAgg       *pictureAggregator
 )
 
 // set the flags
 func init() {
-	// do not download binary
-	webpbin.SkipDownload()
 	flag.StringVar(&dir, "d", "", "the directory to crawl")
 	flag.UintVar(&quality, "q", 0, "the quality for the webp images")
 	flag.BoolVar(&replace, "r", false, "replace existing webp files")
@@ -53,10 +73,25 @@ func init() {
 	flag.StringVar(&appendToName, "append", "", "append string to the end of file name")
 	flag.StringVar(&inputMinFileSize, "min-size", "10KB",
 		"smallest file size that will have a webp image created")
-	flag.BoolVar(&dryRun, "dry-run", false, "whether to handle this as a dry run and only " +
+	flag.BoolVar(&dryRun, "dry-run", false, "whether to handle this as a dry run and only "+
 		"print target files")
-	flag.IntVar(&workers, "w", runtime.NumCPU(), "the number of worker routines to spawn. " +
+	flag.IntVar(&workers, "w", runtime.NumCPU(), "the number of worker routines to spawn. "+
 		"Defaults to number of CPUs.")
+	flag.StringVar(&inputMaxPending, "max-pending", "256MB",
+		"total size of source files allowed to be in flight at once, bounding memory use")
+	flag.StringVar(&logFormat, "log-format", "text", "per-file log format: text, json or pretty")
+	flag.BoolVar(&showProgress, "progress", false, "show a live progress bar, with per-file logs printed above it")
+	flag.StringVar(&encoderName, "encoder", "cwebp", "webp encoder backend: cwebp or native")
+	flag.BoolVar(&lossless, "lossless", false, "encode losslessly (native encoder only)")
+	flag.StringVar(&inputTransforms, "transforms", "",
+		"comma separated pipeline applied to each image before encoding, "+
+			"e.g. exif-rotate,resize:2048,strip-meta,binarize")
+	flag.StringVar(&inputManifest, "manifest", "",
+		"path to the resumable manifest (default: <d>/.gowebp-manifest.json)")
+	flag.StringVar(&inputEmitPicture, "emit-picture", "none",
+		"emit <picture> sidecar markup per conversion: none, per-file or aggregate")
+	flag.StringVar(&webRoot, "web-root", "", "root paths in emitted <picture> markup are made relative to "+
+		"(default: the crawl directory)")
 
 	flag.Parse()
 
@@ -67,87 +102,98 @@ func init() {
 		os.Exit(1)
 	}
 
+	err = maxPendingBytes.UnmarshalText([]byte(inputMaxPending))
+
+	if err != nil {
+		log.Printf("!!ERROR: %s is not a valid file size", inputMaxPending)
+		os.Exit(1)
+	}
+
+	bar = newProgressBar(showProgress, os.Stdout)
+
+	appLogger, err = newLogger(logFormat, bar)
+	if err != nil {
+		log.Printf("!!ERROR: %s", err)
+		os.Exit(1)
+	}
+
+	selectedEncoder, err = newEncoder(encoderName)
+	if err != nil {
+		log.Printf("!!ERROR: %s", err)
+		os.Exit(1)
+	}
+
+	transforms, err = parseTransforms(inputTransforms)
+	if err != nil {
+		log.Printf("!!ERROR: %s", err)
+		os.Exit(1)
+	}
+
+	emitPictureMode, err = parsePictureMode(inputEmitPicture)
+	if err != nil {
+		log.Printf("!!ERROR: %s", err)
+		os.Exit(1)
+	}
+
 	// log to standard output
 	log.SetOutput(os.Stdout)
 }
 
-func mustGetFileSize(file string) int64 {
+func getFileSize(file string) (int64, error) {
 	fi, err := os.Stat(file)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	return fi.Size()
+	return fi.Size(), nil
+}
+
+// isFatal reports whether err should abort the whole run rather than just
+// being logged and skipped for this one file. A single corrupt or oversized
+// source image isn't fatal; a missing/broken cwebp binary is.
+func isFatal(err error) bool {
+	if err == nil {
+		return false
+	}
+	var execErr *exec.Error
+	return errors.As(err, &execErr)
 }
 
 type webpJobResult struct {
 	err         error
 	compression float64
 	exists      bool
+	removed     bool
 	outputFile  string
+	origSize    int64
+	outputSize  int64
 }
 
-func newJob(input string, quality uint) *job {
-	j := &job{
+func newJob(input string, quality uint, size int64) *job {
+	return &job{
 		input:   input,
 		quality: quality,
-		resCh:   make(chan *webpJobResult),
+		size:    size,
 	}
-	return j
 }
 
 type job struct {
 	input   string
 	quality uint
-	res     *webpJobResult
-	resCh   chan *webpJobResult
-}
-
-// waitForResult gets a result for this job only when job completion signal is set
-func (j *job) waitForResult() *webpJobResult {
-	j.res = <-j.resCh
-	return j.res
-}
-
-func newPool(ctx context.Context, workers int) *pool {
-	ctx, done := context.WithCancel(ctx)
-	p := &pool{
-		workers: workers,
-		jobs:    make(chan *job),
-		ctx:     ctx,
-		done:    done,
-		wg:      &sync.WaitGroup{},
-	}
-	p.start()
-	return p
+	size    int64
 }
 
-type pool struct {
-	workers int
-	jobs    chan *job
-	ctx     context.Context
-	done    context.CancelFunc
-	wg      *sync.WaitGroup
-}
-
-// execute executes a compression job
-func (p *pool) execute(j *job) {
-	go j.waitForResult()
+// execute runs a single compression job to completion and returns its result.
+// It never panics on a per-file failure; the caller decides whether the
+// error is fatal enough to cancel the rest of the run.
+func (j *job) execute() *webpJobResult {
 	r := &webpJobResult{}
 
-	// always pass the result to the job's result channel
-	defer func() {
-		j.resCh <- r
-		close(j.resCh)
-	}()
-
-	var (
-		targetExt string
-	)
+	var targetExt string
 
 	// get the absolute path
 	j.input, r.err = filepath.Abs(j.input)
 	if r.err != nil {
-		return
+		return r
 	}
 
 	// get the target's extension
@@ -157,105 +203,226 @@ func (p *pool) execute(j *job) {
 	path := filepath.Dir(j.input)
 
 	// output is the old filepath with new webp extension and prepend and append strings
-	r.outputFile = filepath.Join(path, prependToName + base[:len(base)-len(targetExt)] + appendToName + ".webp")
-
-	// check if file already exists
-	if !replace {
-		if _, err := os.Stat(r.outputFile); err == nil {
-			// file already exists
-			r.exists = true
-			log.Println(j.input, "already has a webp version")
-			return
-		}
-	}
+	r.outputFile = filepath.Join(path, prependToName+base[:len(base)-len(targetExt)]+appendToName+".webp")
 
 	// get the size of the original file
-	fSizeTarget := datasize.ByteSize(mustGetFileSize(j.input))
+	origSize, err := getFileSize(j.input)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	fSizeTarget := datasize.ByteSize(origSize)
+	r.origSize = int64(fSizeTarget)
 
 	if fSizeTarget.Bytes() < minFileSize.Bytes() {
 		// nothing to do
-		log.Printf("%s size [%s] is smaller than the minimum file size [%s]. Skipping...",
+		appLogger.Infof("%s size [%s] is smaller than the minimum file size [%s]. Skipping...",
 			j.input, fSizeTarget.HumanReadable(), minFileSize.HumanReadable())
-		return
+		return r
 	}
 
 	if dryRun {
-		// if it's a dry run then just print and return
-		log.Printf("%s \u2192 %s [?]\n", j.input, r.outputFile)
-		return
+		// if it's a dry run then just print and return, before paying for a
+		// digest of the source or a manifest lookup
+		appLogger.Infof("%s → %s [?]", j.input, r.outputFile)
+		return r
 	}
 
-	r.err = webpbin.NewCWebP().
-		Quality(j.quality).
-		InputFile(j.input).
-		OutputFile(r.outputFile).
-		Run()
+	// a manifest entry matching the source's digest and every param that
+	// affects the output means we've already produced this exact file
+	sha, size, modTime, err := digestFile(j.input)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	candidate := manifestEntry{
+		SHA256:     sha,
+		Size:       size,
+		ModTime:    modTime,
+		Quality:    j.quality,
+		Encoder:    encoderName,
+		Lossless:   lossless,
+		Transforms: inputTransforms,
+	}
+
+	if !replace {
+		if activeManifest.matches(j.input, candidate) {
+			if _, err := os.Stat(r.outputFile); err == nil {
+				r.exists = true
+				appLogger.Infof("%s matches the manifest entry for %s, skipping", r.outputFile, j.input)
+				return r
+			}
+		} else {
+			activeManifest.mu.Lock()
+			_, known := activeManifest.entries[j.input]
+			activeManifest.mu.Unlock()
+
+			// the manifest has no entry for this file (fresh/missing manifest)
+			// but something is already sitting at the output path; honour -r's
+			// documented meaning and don't clobber it. A file whose entry was
+			// made with different params falls through and is re-encoded.
+			if _, err := os.Stat(r.outputFile); err == nil && !known {
+				r.exists = true
+				appLogger.Infof("%s already exists, skipping (pass -r to replace)", r.outputFile)
+				return r
+			}
+		}
+	}
+
+	// the native encoder always needs the image decoded in process; the
+	// cwebp backend only needs it if a transform pipeline has to run first
+	_, native := selectedEncoder.(nativeEncoder)
+	var img image.Image
+	if native || len(transforms) > 0 {
+		img, r.err = decodeImage(j.input)
+		if r.err != nil {
+			return r
+		}
+
+		for _, t := range transforms {
+			img, r.err = t(img, j.input)
+			if r.err != nil {
+				return r
+			}
+		}
+	}
+
+	r.err = selectedEncoder.encode(j.input, img, r.outputFile, encodeOptions{
+		quality:  j.quality,
+		lossless: lossless,
+	})
 
 	if r.err != nil {
-		return
+		return r
 	}
 
 	// get the file size of the new file
-	fSizeOutput := datasize.ByteSize(mustGetFileSize(r.outputFile))
+	outputSize, err := getFileSize(r.outputFile)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	fSizeOutput := datasize.ByteSize(outputSize)
+	r.outputSize = int64(fSizeOutput)
 
 	// calculate the compression percentage
 	r.compression = (1 - (float64(fSizeOutput) / float64(fSizeTarget))) * 100
 
-	if r.err != nil {
-		log.Printf("!ERROR webp generation for %s FAILED with error: %s\n", r.err)
-	} else {
-		if fSizeOutput.Bytes() > fSizeTarget.Bytes() {
-			// webp is bigger than output file???
-			log.Printf("!WARNING output file %s is bigger than input file %s. deleting...", r.outputFile, j.input)
-			r.err = os.Remove(r.outputFile)
-			if r.err != nil {
-				// should never happen this error but return the error if we have one
-				return
-			}
-
+	if fSizeOutput.Bytes() > fSizeTarget.Bytes() {
+		// webp is bigger than output file???
+		appLogger.Warnf("output file %s is bigger than input file %s. deleting...", r.outputFile, j.input)
+		r.err = os.Remove(r.outputFile)
+		if r.err != nil {
+			// should never happen this error but return the error if we have one
+			return r
 		}
-		log.Printf("%s (%s) \u2192 %s (%s) [%.2f%%]\n",
-			j.input, fSizeTarget.HumanReadable(), r.outputFile, fSizeOutput.HumanReadable(), r.compression)
+		r.outputSize = 0
+		r.removed = true
+		return r
 	}
 
-	return
-}
+	appLogger.Infof("%s (%s) → %s (%s) [%.2f%%]",
+		j.input, fSizeTarget.HumanReadable(), r.outputFile, fSizeOutput.HumanReadable(), r.compression)
+
+	candidate.OutputFile = r.outputFile
+	candidate.Compression = r.compression
+	if err := activeManifest.record(j.input, candidate); err != nil {
+		appLogger.Warnf("failed to update manifest for %s: %s", j.input, err)
+	}
 
-func (p *pool) start() {
-	for i := 0; i < p.workers; i++ {
-		p.wg.Add(1)
-		go p.worker()
+	if err := emitPicture(j.input, r.outputFile); err != nil {
+		appLogger.Warnf("failed to emit picture snippet for %s: %s", j.input, err)
 	}
+
+	return r
 }
 
-func (p *pool) wait() {
-	close(p.jobs)
-	p.wg.Wait()
+// pool bounds in-flight work by both worker count and total pending source
+// bytes, using weighted semaphores the way an errgroup-based crawler does.
+// The first fatal job error cancels ctx, which unblocks any goroutine
+// waiting on a semaphore and stops the walk.
+type pool struct {
+	semSlots *semaphore.Weighted
+	semBytes *semaphore.Weighted
+	eg       *errgroup.Group
+	ctx      context.Context
+
+	maxPendingBytes int64
+	results         chan *webpJobResult
 }
 
-func (p *pool) stop() {
-	p.done()
-	p.wg.Wait()
+func newPool(ctx context.Context, workers int, maxPendingBytes int64) *pool {
+	eg, ctx := errgroup.WithContext(ctx)
+	return &pool{
+		semSlots:        semaphore.NewWeighted(int64(workers)),
+		semBytes:        semaphore.NewWeighted(maxPendingBytes),
+		eg:              eg,
+		ctx:             ctx,
+		maxPendingBytes: maxPendingBytes,
+		results:         make(chan *webpJobResult, workers),
+	}
 }
 
-func (p *pool) worker() {
-	defer func() {
-		p.wg.Done()
-	}()
-	for {
+// submit blocks until a worker slot and enough of the pending-bytes budget
+// are available, then runs the job in the background. It returns the pool's
+// context error once a prior fatal job (or the caller) has cancelled the run.
+func (p *pool) submit(j *job) error {
+	weight := j.size
+	if weight <= 0 {
+		weight = 1
+	}
+	if weight > p.maxPendingBytes {
+		// a single file bigger than the whole budget still has to run alone
+		weight = p.maxPendingBytes
+	}
+
+	if err := p.semSlots.Acquire(p.ctx, 1); err != nil {
+		return err
+	}
+	if err := p.semBytes.Acquire(p.ctx, weight); err != nil {
+		p.semSlots.Release(1)
+		return err
+	}
+
+	p.eg.Go(func() error {
+		defer p.semSlots.Release(1)
+		defer p.semBytes.Release(weight)
+
+		r := j.execute()
+
 		select {
-		case j, ok := <-p.jobs:
-			if !ok {
-				// no more work
-				return
-			}
-			// execute a job and pass the result into the result channel
-			p.execute(j)
+		case p.results <- r:
 		case <-p.ctx.Done():
-			// we'imageRe done early
-			return
+			return p.ctx.Err()
 		}
-	}
+
+		if isFatal(r.err) {
+			return r.err
+		}
+		return nil
+	})
+
+	return nil
+}
+
+// wait blocks until every submitted job has finished, then closes results.
+func (p *pool) wait() error {
+	err := p.eg.Wait()
+	close(p.results)
+	return err
+}
+
+// runSummary is the aggregate printed once the walk and every job completes.
+type runSummary struct {
+	filesConverted int
+	bytesSaved     int64
+	elapsed        time.Duration
+}
+
+func (s runSummary) print() {
+	fmt.Println("FILES CONVERTED:\t", s.filesConverted)
+	fmt.Println("BYTES SAVED:\t\t", datasize.ByteSize(s.bytesSaved).HumanReadable())
+	fmt.Println("TIME TAKEN:\t\t", s.elapsed)
 }
 
 func main() {
@@ -271,7 +438,7 @@ Usage:
 		os.Exit(1)
 	}
 
-	p := newPool(context.Background(), workers)
+	p := newPool(context.Background(), workers, int64(maxPendingBytes.Bytes()))
 
 	dir = strings.TrimSpace(dir)
 
@@ -282,35 +449,101 @@ Usage:
 		os.Exit(2)
 	}
 
+	manifestPath := inputManifest
+	if manifestPath == "" {
+		manifestPath = filepath.Join(dir, ".gowebp-manifest.json")
+	}
+	activeManifest, err = loadManifest(manifestPath)
+	if err != nil {
+		fmt.Println("failed to load manifest:", err)
+		os.Exit(2)
+	}
+
+	if webRoot == "" {
+		webRoot = dir
+	}
+	if emitPictureMode == pictureAggregate {
+		pictureAgg = newPictureAggregator(filepath.Join(webRoot, "picture-snippets.html"))
+	}
+
 	fmt.Println("CRAWLING:\t", dir)
 	fmt.Println("QUALITY:\t", quality)
 	fmt.Println("WORKERS:\t", workers)
 	fmt.Println("MIN FILE SIZE:\t", minFileSize.String())
+	fmt.Println("MAX PENDING:\t", maxPendingBytes.String())
+	fmt.Println("MANIFEST:\t", manifestPath)
 	if dryRun {
 		fmt.Println("*** THIS IS A DRY RUN ***")
 	}
 
-	// stop pool when exiting
-	defer p.stop()
+	start := time.Now()
+
+	// collect per-file results as they arrive so job execution is never
+	// blocked waiting on a reader
+	var summaryMu sync.Mutex
+	summary := runSummary{}
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for r := range p.results {
+			bar.Increment()
+			if r.err != nil && !isFatal(r.err) {
+				appLogger.Errorf("webp generation for %s failed: %s", r.outputFile, r.err)
+			}
+			if r.err != nil || r.exists || r.removed || dryRun {
+				continue
+			}
+			saved := r.origSize - r.outputSize
+			if saved <= 0 {
+				continue
+			}
+			summaryMu.Lock()
+			summary.filesConverted++
+			summary.bytesSaved += saved
+			summaryMu.Unlock()
+		}
+	}()
 
-	cnt := 0
-	err = filepath.Walk(dir,
+	var filesFound int64
+	walkErr := filepath.Walk(dir,
 		func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
 
-			if imageRe.MatchString(info.Name()) {
-				//log.Println("found image:", path)
-				p.jobs <- newJob(path, quality)
-				cnt += 1
+			if !imageRe.MatchString(info.Name()) {
+				return nil
+			}
+
+			filesFound++
+			bar.SetTotal(filesFound)
+
+			if err := p.submit(newJob(path, quality, info.Size())); err != nil {
+				// pool is shutting down because of a fatal error elsewhere
+				return err
 			}
 
 			return nil
 		})
-	if err != nil {
-		log.Println("!!ERROR", err)
+
+	jobErr := p.wait()
+	<-collected
+	bar.Finish()
+
+	if emitPictureMode == pictureAggregate {
+		if err := pictureAgg.save(); err != nil {
+			log.Println("!!ERROR failed to write picture-snippets.html:", err)
+		}
 	}
 
-	p.wait()
+	summary.elapsed = time.Since(start)
+	summary.print()
+
+	if walkErr != nil && !errors.Is(walkErr, context.Canceled) {
+		log.Println("!!ERROR", walkErr)
+	}
+	if jobErr != nil {
+		log.Println("!!ERROR", jobErr)
+		os.Exit(1)
+	}
 }
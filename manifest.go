@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// manifestEntry records everything about one conversion that could make a
+// future run decide to redo it: the source's digest plus every parameter
+// that affects the output.
+type manifestEntry struct {
+	SHA256      string    `json:"sha256"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	Quality     uint      `json:"quality"`
+	Encoder     string    `json:"encoder"`
+	Lossless    bool      `json:"lossless"`
+	Transforms  string    `json:"transforms"`
+	OutputFile  string    `json:"output_file"`
+	Compression float64   `json:"compression"`
+}
+
+// matchesParams reports whether two entries were produced from the same
+// source digest with the same encode parameters, ignoring size, mtime and
+// the fields that only describe the result.
+func (e manifestEntry) matchesParams(other manifestEntry) bool {
+	return e.SHA256 == other.SHA256 &&
+		e.Quality == other.Quality &&
+		e.Encoder == other.Encoder &&
+		e.Lossless == other.Lossless &&
+		e.Transforms == other.Transforms
+}
+
+// manifest is the persistent, content-addressed skip cache keyed by the
+// absolute source path. It's safe for concurrent workers: matches/record take
+// an internal mutex, and record writes via a temp file + rename so a reader
+// never sees a half-written manifest.
+type manifest struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]manifestEntry
+}
+
+func loadManifest(path string) (*manifest, error) {
+	m := &manifest{path: path, entries: map[string]manifestEntry{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &m.entries); err != nil {
+		return nil, fmt.Errorf("manifest %s is corrupt: %w", path, err)
+	}
+	return m, nil
+}
+
+// matches reports whether key already has a manifest entry produced with the
+// same digest and parameters as candidate.
+func (m *manifest) matches(key string, candidate manifestEntry) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.entries[key]
+	return ok && existing.matchesParams(candidate)
+}
+
+// record stores entry for key and persists the manifest immediately, so a
+// run that's interrupted partway still has every completed file recorded.
+// The mutex is held across the write so two workers finishing close
+// together can never have the earlier snapshot land on disk after the
+// later, more-complete one.
+func (m *manifest) record(key string, entry manifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = entry
+	data, err := json.MarshalIndent(m.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(m.path, data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".gowebp-manifest-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, path)
+}
+
+// digestFile returns the hex SHA-256 of path and the size/mtime it was
+// computed from.
+func digestFile(path string) (sha string, size int64, modTime time.Time, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", 0, time.Time{}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, time.Time{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", 0, time.Time{}, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), fi.Size(), fi.ModTime(), nil
+}
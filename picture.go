@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// pictureMode selects how (if at all) gowebp emits <picture> sidecar markup
+// for a converted file.
+type pictureMode int
+
+const (
+	pictureNone pictureMode = iota
+	picturePerFile
+	pictureAggregate
+)
+
+func parsePictureMode(s string) (pictureMode, error) {
+	switch s {
+	case "", "none":
+		return pictureNone, nil
+	case "per-file":
+		return picturePerFile, nil
+	case "aggregate":
+		return pictureAggregate, nil
+	default:
+		return pictureNone, fmt.Errorf("unknown -emit-picture %q (want none, per-file or aggregate)", s)
+	}
+}
+
+// pictureAggregator collects <picture> blocks across the whole run so they
+// can be written out as a single picture-snippets.html once the walk and
+// every job completes.
+type pictureAggregator struct {
+	mu       sync.Mutex
+	path     string
+	snippets []string
+}
+
+func newPictureAggregator(path string) *pictureAggregator {
+	return &pictureAggregator{path: path}
+}
+
+func (a *pictureAggregator) add(html string) {
+	a.mu.Lock()
+	a.snippets = append(a.snippets, html)
+	a.mu.Unlock()
+}
+
+func (a *pictureAggregator) save() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.snippets) == 0 {
+		return nil
+	}
+
+	var buf strings.Builder
+	buf.WriteString("<!-- generated by gowebp, one <picture> block per converted file -->\n")
+	for _, s := range a.snippets {
+		buf.WriteString(s)
+	}
+
+	return os.WriteFile(a.path, []byte(buf.String()), 0644)
+}
+
+// emitPicture renders and stores/writes the <picture> block for one
+// conversion, honouring the active -emit-picture mode. It's a no-op when
+// picture emission is disabled.
+func emitPicture(srcPath, webpOutputFile string) error {
+	if emitPictureMode == pictureNone {
+		return nil
+	}
+
+	webpRel, err := relativeToWebRoot(webRoot, webpOutputFile)
+	if err != nil {
+		return err
+	}
+	origRel, err := relativeToWebRoot(webRoot, srcPath)
+	if err != nil {
+		return err
+	}
+
+	html := renderPictureBlock(webpRel, origRel)
+
+	switch emitPictureMode {
+	case picturePerFile:
+		return writePerFileSnippet(webpOutputFile, html)
+	case pictureAggregate:
+		pictureAgg.add(html)
+	}
+
+	return nil
+}
+
+func relativeToWebRoot(root, path string) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func renderPictureBlock(webpRel, origRel string) string {
+	return fmt.Sprintf("<picture>\n"+
+		"  <source type=\"image/webp\" srcset=\"%s\">\n"+
+		"  <img src=\"%s\">\n"+
+		"</picture>\n", webpRel, origRel)
+}
+
+func writePerFileSnippet(webpOutputFile, html string) error {
+	path := strings.TrimSuffix(webpOutputFile, filepath.Ext(webpOutputFile)) + ".html"
+	return os.WriteFile(path, []byte(html), 0644)
+}
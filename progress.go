@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// progressBar wraps a cheggaaa/pb bar: Increment() advances it by one,
+// SetTotal() grows it as the walker discovers more files, and writeAbove()
+// lets a logger print a line without corrupting the bar's current row.
+type progressBar struct {
+	mu      sync.Mutex
+	out     io.Writer
+	enabled bool
+	inner   *pb.ProgressBar
+}
+
+func newProgressBar(enabled bool, out io.Writer) *progressBar {
+	b := &progressBar{out: out, enabled: enabled}
+	if !enabled {
+		return b
+	}
+
+	b.inner = pb.New64(0)
+	b.inner.SetTemplate(pb.Full)
+	b.inner.SetWriter(out)
+	b.inner.Start()
+	return b
+}
+
+// SetTotal updates the bar's denominator. Safe to call repeatedly as the
+// walker finds more files.
+func (b *progressBar) SetTotal(n int64) {
+	if !b.enabled {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inner.SetTotal(n)
+}
+
+// Increment advances the bar by one completed job.
+func (b *progressBar) Increment() {
+	if !b.enabled {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inner.Increment()
+}
+
+// writeAbove prints a log line without leaving bar artifacts behind it.
+func (b *progressBar) writeAbove(line string) {
+	if !b.enabled {
+		fmt.Fprintln(b.out, line)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprint(b.out, "\r\033[K")
+	fmt.Fprintln(b.out, line)
+	b.inner.Write()
+}
+
+// Finish stops the bar so the next output starts on its own line.
+func (b *progressBar) Finish() {
+	if !b.enabled {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inner.Finish()
+}